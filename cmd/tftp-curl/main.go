@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"os"
 
 	tftp "github.com/wjholden/GoTFTPd/internal"
 )
 
 var (
-	server    = flag.String("server", "", "* mandatory")
-	filename  = flag.String("filename", "", "* mandatory")
-	blocksize = flag.Int("blocksize", 512, "transfer blocksize")
-	timeout   = flag.Int("timeout", 1, "timeout in seconds")
+	server     = flag.String("server", "", "* mandatory")
+	filename   = flag.String("filename", "", "* mandatory")
+	blocksize  = flag.Int("blocksize", 512, "transfer blocksize")
+	timeout    = flag.Int("timeout", 1, "timeout in seconds")
+	windowsize = flag.Int("windowsize", 1, "RFC 7440 windowsize (number of blocks sent before an ACK is required)")
+	put        = flag.Bool("put", false, "upload filename to the server instead of downloading it")
 )
 
 // The client here wasn't really planned as the focus of this project. I mostly
@@ -34,7 +38,20 @@ func main() {
 	}
 
 	c := tftp.TftpClient{}
-	err = c.ReadRequest(*server, *filename, *blocksize, *timeout)
+	if *put {
+		f, ferr := os.Open(*filename)
+		if ferr != nil {
+			log.Fatal(ferr)
+		}
+		defer f.Close()
+		var size int64
+		if info, serr := f.Stat(); serr == nil {
+			size = info.Size()
+		}
+		err = c.WriteRequest(context.Background(), *server, *filename, f, size, *blocksize, *timeout, *windowsize)
+	} else {
+		err = c.ReadRequest(context.Background(), *server, *filename, *blocksize, *timeout, *windowsize)
+	}
 
 	if err != nil {
 		log.Fatal(err)
@@ -1,22 +1,45 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	tftp "github.com/wjholden/GoTFTPd/internal"
 )
 
 var (
-	discard  = flag.Bool("discard", false, "accept transfers but don't actually write them to disk")
-	port     = flag.Int("port", 69, "UDP port to listen on")
-	readonly = flag.Bool("readonly", false, "reject all writes")
+	discard                = flag.Bool("discard", false, "accept transfers but don't actually write them to disk")
+	port                   = flag.Int("port", 69, "UDP port to listen on")
+	readonly               = flag.Bool("readonly", false, "reject all writes")
+	windowsize             = flag.Int("windowsize", 0, "maximum RFC 7440 windowsize to accept from a client (0 = use the built-in default)")
+	maxConcurrentTransfers = flag.Int("max-transfers", 0, "maximum number of concurrent transfers (0 = unlimited)")
 )
 
 func main() {
 	flag.Parse()
 	s := tftp.TftpServer{TftpNode: tftp.TftpNode{
 		DiscardData: *discard,
-		ReadOnly:    *readonly},
-		Port: *port}
+		ReadOnly:    *readonly,
+		WindowSize:  *windowsize},
+		Port:                   *port,
+		MaxConcurrentTransfers: *maxConcurrentTransfers}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fmt.Fprintln(os.Stderr, "shutting down, canceling in-flight transfers...")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, "shutdown:", err)
+		}
+	}()
+
 	s.Listen()
 }
@@ -0,0 +1,38 @@
+package tftp
+
+import (
+	"fmt"
+	"net"
+)
+
+// Authorizer decides whether a remote client may read or write a given
+// filename, checked from handleClient before the file is opened. A nil
+// Authorizer on TftpNode allows everything, matching GoTFTPd's historical
+// wide-open behavior.
+type Authorizer interface {
+	AllowRead(remoteAddr *net.UDPAddr, filename string) error
+	AllowWrite(remoteAddr *net.UDPAddr, filename string) error
+}
+
+// CIDRAuthorizer allows RRQ/WRQ only from addresses inside one of Networks.
+// An empty Networks list denies everything.
+type CIDRAuthorizer struct {
+	Networks []*net.IPNet
+}
+
+func (a *CIDRAuthorizer) AllowRead(remoteAddr *net.UDPAddr, filename string) error {
+	return a.allow(remoteAddr)
+}
+
+func (a *CIDRAuthorizer) AllowWrite(remoteAddr *net.UDPAddr, filename string) error {
+	return a.allow(remoteAddr)
+}
+
+func (a *CIDRAuthorizer) allow(remoteAddr *net.UDPAddr) error {
+	for _, n := range a.Networks {
+		if n.Contains(remoteAddr.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not in an allowed network", remoteAddr.IP)
+}
@@ -0,0 +1,302 @@
+package tftp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Backend abstracts where RRQ/WRQ data actually comes from or goes to, so a
+// TftpNode doesn't have to read and write the local filesystem directly.
+// This is what lets GoTFTPd be embedded for things like PXE/netboot, where
+// an image might be synthesized on demand instead of sitting on disk.
+type Backend interface {
+	// OpenRead opens filename for an RRQ and reports its size. handleClient
+	// answers the tsize option from Stat, not from this size.
+	OpenRead(filename string, remoteAddr *net.UDPAddr) (io.ReaderAt, int64, error)
+
+	// OpenWrite opens filename for a WRQ. tsize is the size the client
+	// advertised, or 0 if it didn't send one.
+	OpenWrite(filename string, remoteAddr *net.UDPAddr, tsize int) (io.WriteCloser, error)
+
+	// Stat reports the size of filename without opening it, used to answer
+	// the tsize option on an RRQ.
+	Stat(filename string, remoteAddr *net.UDPAddr) (int64, error)
+}
+
+// DirBackend serves files from a directory on the local filesystem, the way
+// GoTFTPd has always behaved, except that filename is resolved underneath
+// Root instead of being blindly concatenated onto "./" -- so a request for
+// "../../etc/passwd" can't escape Root.
+type DirBackend struct {
+	Root string // defaults to "." if empty
+}
+
+func (d *DirBackend) resolve(filename string) string {
+	root := d.Root
+	if root == "" {
+		root = "."
+	}
+	// filepath.Clean("/"+filename) collapses any ".." before we ever join it
+	// to Root, so the result can't climb above Root.
+	return filepath.Join(root, filepath.Clean(string(filepath.Separator)+filename))
+}
+
+func (d *DirBackend) OpenRead(filename string, remoteAddr *net.UDPAddr) (io.ReaderAt, int64, error) {
+	f, err := os.Open(d.resolve(filename))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (d *DirBackend) OpenWrite(filename string, remoteAddr *net.UDPAddr, tsize int) (io.WriteCloser, error) {
+	path := d.resolve(filename)
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists", filename)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if tsize > 0 {
+		if err := f.Truncate(int64(tsize)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+func (d *DirBackend) Stat(filename string, remoteAddr *net.UDPAddr) (int64, error) {
+	info, err := os.Stat(d.resolve(filename))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// MapBackend serves read-only files out of an in-memory map. It's meant for
+// tests and tiny embedded deployments (e.g. a handful of PXE files baked
+// into the binary) that have no reason to touch disk at all.
+type MapBackend struct {
+	Files map[string][]byte
+}
+
+func (m *MapBackend) OpenRead(filename string, remoteAddr *net.UDPAddr) (io.ReaderAt, int64, error) {
+	data, ok := m.Files[filename]
+	if !ok {
+		return nil, 0, fmt.Errorf("%s not found", filename)
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+func (m *MapBackend) OpenWrite(filename string, remoteAddr *net.UDPAddr, tsize int) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("MapBackend is read-only")
+}
+
+func (m *MapBackend) Stat(filename string, remoteAddr *net.UDPAddr) (int64, error) {
+	data, ok := m.Files[filename]
+	if !ok {
+		return 0, fmt.Errorf("%s not found", filename)
+	}
+	return int64(len(data)), nil
+}
+
+// HTTPBackend proxies RRQ reads to an upstream HTTP server, e.g. to let
+// legacy netboot clients pull artifacts straight out of an object store or
+// build server without mirroring them onto the TFTP host's disk first.
+// It's read-only.
+type HTTPBackend struct {
+	BaseURL string
+}
+
+func (h *HTTPBackend) url(filename string) string {
+	return strings.TrimRight(h.BaseURL, "/") + "/" + strings.TrimLeft(filename, "/")
+}
+
+func (h *HTTPBackend) OpenRead(filename string, remoteAddr *net.UDPAddr) (io.ReaderAt, int64, error) {
+	resp, err := http.Get(h.url(filename))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("upstream returned %s for %s", resp.Status, filename)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+func (h *HTTPBackend) OpenWrite(filename string, remoteAddr *net.UDPAddr, tsize int) (io.WriteCloser, error) {
+	return nil, fmt.Errorf("HTTPBackend is read-only")
+}
+
+func (h *HTTPBackend) Stat(filename string, remoteAddr *net.UDPAddr) (int64, error) {
+	resp, err := http.Head(h.url(filename))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("upstream returned %s for %s", resp.Status, filename)
+	}
+
+	return resp.ContentLength, nil
+}
+
+// FSWriter is the write counterpart to fs.FS: fs.FS only exposes Open, so an
+// FSBackend that wants to accept WRQ writes needs a matching create-a-file
+// interface to pair with its read-side FS.
+type FSWriter interface {
+	// Create opens name for writing. name has already been through
+	// sanitizeFSPath. An error whose text contains "already exists" is
+	// reported to the client as ERR_ALREADY_EXISTS.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// DirFSWriter implements FSWriter by creating files under Root on the local
+// filesystem, mirroring os.DirFS on the read side. It refuses to overwrite a
+// file that already exists.
+type DirFSWriter struct {
+	Root string // defaults to "." if empty
+}
+
+func (w *DirFSWriter) Create(name string) (io.WriteCloser, error) {
+	root := w.Root
+	if root == "" {
+		root = "."
+	}
+	path := filepath.Join(root, name)
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists", name)
+	}
+	return os.Create(path)
+}
+
+// sanitizeFSPath rejects absolute paths and ".." traversal before filename
+// ever reaches fs.FS.Open or an FSWriter, so an escaping request is reported
+// as the access violation it is instead of whatever error fs.ValidPath's
+// caller happens to surface.
+func sanitizeFSPath(filename string) (string, error) {
+	clean := strings.TrimLeft(filename, "/")
+	if filepath.IsAbs(filename) || !fs.ValidPath(clean) {
+		return "", fmt.Errorf("%s: access violation: path escapes root", filename)
+	}
+	return clean, nil
+}
+
+// FSBackend serves RRQs out of FS (e.g. an embed.FS for baked-in firmware
+// images, or an fstest.MapFS in unit tests) and, if WriteFS is set, accepts
+// WRQs through it. A zero-value FSBackend behaves like DirBackend: reads and
+// writes "." on the local filesystem. Symlinks are resolved by FS itself:
+// the default os.DirFS follows them, including ones that point outside the
+// root, just as DirBackend does.
+type FSBackend struct {
+	FS      fs.FS    // defaults to os.DirFS(".") if nil
+	WriteFS FSWriter // defaults to a DirFSWriter rooted at "." if nil
+}
+
+func (b *FSBackend) fsOrDefault() fs.FS {
+	if b.FS != nil {
+		return b.FS
+	}
+	return os.DirFS(".")
+}
+
+func (b *FSBackend) writeFSOrDefault() FSWriter {
+	if b.WriteFS != nil {
+		return b.WriteFS
+	}
+	return &DirFSWriter{Root: "."}
+}
+
+func (b *FSBackend) open(filename string) (fs.File, error) {
+	clean, err := sanitizeFSPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	return b.fsOrDefault().Open(clean)
+}
+
+func (b *FSBackend) OpenRead(filename string, remoteAddr *net.UDPAddr) (io.ReaderAt, int64, error) {
+	f, err := b.open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		// Most fs.FS implementations (os.DirFS, embed.FS) already return a
+		// ReaderAt; fall back to buffering the handful that don't.
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+		return bytes.NewReader(data), int64(len(data)), nil
+	}
+
+	return ra, info.Size(), nil
+}
+
+func (b *FSBackend) OpenWrite(filename string, remoteAddr *net.UDPAddr, tsize int) (io.WriteCloser, error) {
+	clean, err := sanitizeFSPath(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := b.writeFSOrDefault().Create(clean)
+	if err != nil {
+		return nil, err
+	}
+
+	if tsize > 0 {
+		if t, ok := f.(interface{ Truncate(int64) error }); ok {
+			if err := t.Truncate(int64(tsize)); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return f, nil
+}
+
+func (b *FSBackend) Stat(filename string, remoteAddr *net.UDPAddr) (int64, error) {
+	clean, err := sanitizeFSPath(filename)
+	if err != nil {
+		return 0, err
+	}
+	info, err := fs.Stat(b.fsOrDefault(), clean)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -1,60 +1,126 @@
 package tftp
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"os"
+	"strconv"
 	"time"
 )
 
+// maxHandshakeRetries bounds how many times Transfer resends the initial
+// RRQ/WRQ while waiting for the server's first reply (which also tells us
+// its ephemeral TID).
+const maxHandshakeRetries = 5
+
 type TftpClient struct {
 	TftpSession
 	Server string
 }
 
-func (c *TftpClient) Transfer(opcode OpCode) (err error) {
+func (c *TftpClient) Transfer(ctx context.Context, opcode OpCode) (err error) {
+	c.ctx = ctx
+
 	// Start a server socket to listen on from all sources
-	conn1, _ := net.ListenUDP("udp", nil)
+	conn1, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
 	defer conn1.Close()
-	laddr, _ := net.ResolveUDPAddr("udp", conn1.LocalAddr().String())
+	laddr, err := net.ResolveUDPAddr("udp", conn1.LocalAddr().String())
+	if err != nil {
+		return err
+	}
 
 	// Dial the server on their port 69 (or whatever)
-	raddr1, _ := net.ResolveUDPAddr("udp", c.Server)
-	//conn2, err := net.DialUDP("udp", laddr, raddr1)
-	//if err != nil {
-	//	return
-	//}
-	//defer conn2.Close()
+	raddr1, err := net.ResolveUDPAddr("udp", c.Server)
+	if err != nil {
+		return err
+	}
 
 	// Send the RRQ/WRQ packet.
-	var buf bytes.Buffer
-	buf.Write([]byte{0, byte(opcode)})
-	buf.WriteString(c.Filename)
-	buf.WriteByte(0)
-	buf.WriteString("octet")
-	buf.WriteByte(0)
-	//conn2.Write(buf.Bytes())
-	conn1.WriteToUDP(buf.Bytes(), raddr1)
-
-	// The server should respond on an ephemeral port.
-	// We are going to lose this packet, but the server should re-send it.
+	options := make(map[string]string)
+	if c.blocksize > 0 && c.blocksize != 512 {
+		options["blksize"] = strconv.Itoa(c.blocksize)
+	}
+	if c.window > 1 {
+		options["windowsize"] = strconv.Itoa(c.window)
+	}
+	if opcode == OPCODE_WRQ && c.tsize > 0 {
+		options["tsize"] = strconv.Itoa(c.tsize)
+	} else if opcode == OPCODE_RRQ {
+		options["tsize"] = "0"
+	}
+	if c.mode == "" {
+		c.mode = "octet"
+	}
+	var req Packet
+	switch opcode {
+	case OPCODE_RRQ:
+		req = &RRQ{Filename: c.Filename, Mode: c.mode, Options: options}
+	case OPCODE_WRQ:
+		req = &WRQ{Filename: c.Filename, Mode: c.mode, Options: options}
+	}
+
+	timeout := c.timeout
+	if timeout <= 0 {
+		timeout = 1 * time.Second
+	}
+
+	// The server should respond on an ephemeral port. Resend the request on
+	// timeout, since a lost RRQ/WRQ otherwise hangs forever.
 	readbuf := make([]byte, 1500)
-	_, raddr2, _ := conn1.ReadFromUDP(readbuf)
+	var n int
+	var raddr2 *net.UDPAddr
+	for retries := 0; ; retries++ {
+		wire, _ := c.codecOrDefault().Marshal(req)
+		conn1.WriteToUDP(wire, raddr1)
+		conn1.SetReadDeadline(time.Now().Add(timeout))
+		n, raddr2, err = conn1.ReadFromUDP(readbuf)
+		if err == nil {
+			break
+		}
+		if retries >= maxHandshakeRetries {
+			return fmt.Errorf("no response from %s: %w", c.Server, err)
+		}
+	}
 
 	// Now that we know the server's TID we can actually dial them from our
-	// "server" port.
+	// "server" port. Deliberate deviation from RFC 1350 section 4: a
+	// connected UDP socket has the kernel silently discard any datagram not
+	// from that address:port before it ever reaches us, so a genuinely
+	// mismatched-TID packet is never observed here to reply to with
+	// ERR_UNKNOWN_TID. handleClient's server-side session has the same
+	// property (see server.go's net.DialUDP call) for the same reason.
 	conn1.Close()
 	conn3, err := net.DialUDP("udp", laddr, raddr2)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer conn3.Close()
 	c.conn = conn3
 
 	fmt.Println(conn3.LocalAddr().String(), conn3.RemoteAddr().String())
 
+	if reply, perr := c.codecOrDefault().Unmarshal(readbuf[:n]); perr == nil {
+		if oack, ok := reply.(*OACK); ok {
+			// The server accepted (possibly narrowed) some of our options.
+			// Lock them in before starting the transfer.
+			c.applyOack(oack)
+			if opcode == OPCODE_RRQ {
+				c.tftpSendAck(0)
+			}
+		} else {
+			// No OACK (e.g. the server didn't accept any options), so this
+			// is DATA block 1 / the first ACK. Feed it straight into
+			// receive()/send() instead of discarding it and waiting out a
+			// full timeout for the server to retransmit.
+			c.seed = reply
+		}
+	}
+
 	// Actually do the transfer. The names look reversed because we're reusing
 	// server code.
 	switch opcode {
@@ -66,11 +132,81 @@ func (c *TftpClient) Transfer(opcode OpCode) (err error) {
 	return
 }
 
-func (c *TftpClient) ReadRequest(server string, filename string, blocksize int, timeout int) (err error) {
-	c.output = os.Stdout
-	c.Server = server
+// applyOack updates the session with whatever options the server accepted
+// (possibly narrowed) in its OACK reply.
+func (c *TftpClient) applyOack(oack *OACK) {
+	for key, value := range oack.Options {
+		switch key {
+		case "blksize":
+			if v, err := strconv.Atoi(value); err == nil {
+				c.blocksize = v
+			}
+		case "windowsize":
+			if v, err := strconv.Atoi(value); err == nil {
+				c.window = v
+			}
+		case "tsize":
+			if v, err := strconv.Atoi(value); err == nil {
+				c.tsize = v
+			}
+		}
+	}
+}
+
+// defaultUnsetOptions fills in the blocksize/timeout a zero-value
+// TftpClient needs to function: 512 is the un-negotiated RFC 1350
+// blocksize, and 1s matches Transfer's own handshake fallback. Without
+// this, a caller that never touched those unexported fields would see
+// receive() allocate a near-empty read buffer and the read deadline fire
+// immediately.
+func (c *TftpClient) defaultUnsetOptions() {
+	if c.blocksize <= 0 {
+		c.blocksize = 512
+	}
+	if c.timeout <= 0 {
+		c.timeout = 1 * time.Second
+	}
+}
+
+// Get downloads filename from remote into w, honoring the client's
+// configured blksize/timeout/tsize/windowsize, and returns the number of
+// bytes written to w.
+func (c *TftpClient) Get(ctx context.Context, remote string, filename string, w io.Writer) (int64, error) {
+	c.Server = remote
+	c.Filename = filename
+	c.output = w
+	c.defaultUnsetOptions()
+	err := c.Transfer(ctx, OPCODE_RRQ)
+	return int64(c.bytes), err
+}
+
+// Put uploads size bytes read from r to filename on remote (size may be 0
+// if unknown, in which case tsize is omitted), and returns the number of
+// bytes sent.
+func (c *TftpClient) Put(ctx context.Context, remote string, filename string, r io.Reader, size int64) (int64, error) {
+	c.Server = remote
 	c.Filename = filename
+	c.tsize = int(size)
+	c.input = &readerAtFromReader{r: r}
+	c.defaultUnsetOptions()
+	err := c.Transfer(ctx, OPCODE_WRQ)
+	return int64(c.bytes), err
+}
+
+func (c *TftpClient) ReadRequest(ctx context.Context, server string, filename string, blocksize int, timeout int, windowsize int) (err error) {
+	c.blocksize = blocksize
+	c.timeout = time.Duration(timeout) * time.Second
+	c.window = windowsize
+	_, err = c.Get(ctx, server, filename, os.Stdout)
+	return
+}
+
+// WriteRequest uploads filename to server from r, mirroring ReadRequest's
+// parameters for symmetry in the CLI tools.
+func (c *TftpClient) WriteRequest(ctx context.Context, server string, filename string, r io.Reader, size int64, blocksize int, timeout int, windowsize int) (err error) {
 	c.blocksize = blocksize
 	c.timeout = time.Duration(timeout) * time.Second
-	return c.Transfer(OPCODE_RRQ)
+	c.window = windowsize
+	_, err = c.Put(ctx, server, filename, r, size)
+	return
 }
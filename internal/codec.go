@@ -0,0 +1,26 @@
+package tftp
+
+// Codec marshals and unmarshals Packet values. Packet.Pack/ParsePacket (see
+// packet.go) are the only wire format this package speaks today, but
+// routing through a Codec is what lets a future alternative encoding, or a
+// new opcode that needs bespoke handling, be added without touching
+// handleClient or the session send/receive paths again.
+type Codec interface {
+	Marshal(p Packet) ([]byte, error)
+	Unmarshal(buf []byte) (Packet, error)
+}
+
+// wireCodec is the RFC 1350/2347/7440 on-the-wire Codec, implemented in
+// terms of Packet.Pack and ParsePacket.
+type wireCodec struct{}
+
+func (wireCodec) Marshal(p Packet) ([]byte, error) {
+	return p.Pack(), nil
+}
+
+func (wireCodec) Unmarshal(buf []byte) (Packet, error) {
+	return ParsePacket(buf)
+}
+
+// DefaultCodec is the Codec this package uses internally.
+var DefaultCodec Codec = wireCodec{}
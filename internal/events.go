@@ -0,0 +1,42 @@
+package tftp
+
+import (
+	"log/slog"
+	"net"
+	"time"
+)
+
+// EventHandler receives lifecycle notifications for every transfer, so
+// operators can wire up structured logging or metrics instead of the
+// server's default colored fmt.Println output. A nil EventHandler on
+// TftpNode disables notifications entirely.
+type EventHandler interface {
+	OnRequest(remoteAddr *net.UDPAddr, filename string, opcode OpCode)
+	OnComplete(remoteAddr *net.UDPAddr, filename string, bytes int, md5sum string, duration time.Duration)
+	OnError(remoteAddr *net.UDPAddr, filename string, err error)
+}
+
+// SlogEventHandler adapts EventHandler onto log/slog. A nil Logger falls
+// back to slog.Default().
+type SlogEventHandler struct {
+	Logger *slog.Logger
+}
+
+func (h *SlogEventHandler) logger() *slog.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return slog.Default()
+}
+
+func (h *SlogEventHandler) OnRequest(remoteAddr *net.UDPAddr, filename string, opcode OpCode) {
+	h.logger().Info("tftp request", "remote", remoteAddr.String(), "filename", filename, "opcode", opcode)
+}
+
+func (h *SlogEventHandler) OnComplete(remoteAddr *net.UDPAddr, filename string, bytes int, md5sum string, duration time.Duration) {
+	h.logger().Info("tftp complete", "remote", remoteAddr.String(), "filename", filename, "bytes", bytes, "md5", md5sum, "duration", duration)
+}
+
+func (h *SlogEventHandler) OnError(remoteAddr *net.UDPAddr, filename string, err error) {
+	h.logger().Error("tftp error", "remote", remoteAddr.String(), "filename", filename, "error", err)
+}
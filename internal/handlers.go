@@ -0,0 +1,66 @@
+package tftp
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// ReadHandlerFunc serves an RRQ: it receives the requested filename and the
+// client's address, and must either stream the file's bytes into rf (via
+// rf.ReadFrom) or return an error.
+type ReadHandlerFunc func(filename string, raddr *net.UDPAddr, rf io.ReaderFrom) error
+
+// WriteHandlerFunc serves a WRQ: it receives the requested filename and the
+// client's address, and must either drain the incoming transfer into some
+// destination (via wt.WriteTo) or return an error.
+type WriteHandlerFunc func(filename string, raddr *net.UDPAddr, wt io.WriterTo) error
+
+// SetReadHandler installs a handler that serves every RRQ, bypassing the
+// TftpNode's Backend entirely. This lets an embedder serve from an fs.FS,
+// S3, an in-memory map, or anywhere else without implementing Backend.
+func (s *TftpServer) SetReadHandler(h ReadHandlerFunc) {
+	s.readHandler = h
+}
+
+// SetWriteHandler installs a handler that serves every WRQ, bypassing the
+// TftpNode's Backend entirely.
+func (s *TftpServer) SetWriteHandler(h WriteHandlerFunc) {
+	s.writeHandler = h
+}
+
+// ReadFrom implements io.ReaderFrom, letting a ReadHandlerFunc pump an
+// arbitrary sequential source through this session's sliding-window send().
+func (s *TftpSession) ReadFrom(r io.Reader) (int64, error) {
+	s.input = &readerAtFromReader{r: r}
+	err := s.send()
+	return int64(s.bytes), err
+}
+
+// WriteTo implements io.WriterTo, letting a WriteHandlerFunc drain this
+// session's incoming transfer into an arbitrary destination.
+func (s *TftpSession) WriteTo(w io.Writer) (int64, error) {
+	s.output = w
+	err := s.receive()
+	return int64(s.bytes), err
+}
+
+// readerAtFromReader adapts a sequential io.Reader to the io.ReaderAt that
+// send() expects. It only supports the sequential, non-overlapping access
+// pattern send() actually uses (reads never repeat or skip ahead).
+type readerAtFromReader struct {
+	r   io.Reader
+	off int64
+}
+
+func (a *readerAtFromReader) ReadAt(p []byte, off int64) (int, error) {
+	if off != a.off {
+		return 0, fmt.Errorf("readerAtFromReader: non-sequential read at %d, expected %d", off, a.off)
+	}
+	n, err := io.ReadFull(a.r, p)
+	a.off += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,112 @@
+package tftp
+
+// netascii.go implements the wire translation RFC 1350 requires for the
+// "netascii" transfer mode: LF becomes CR LF, and a bare CR becomes CR NUL.
+// Both translators are streaming so a CR landing on the last byte of one
+// DATA block is carried over correctly into the next.
+
+import "io"
+
+// sequentialReaderAt adapts an io.ReaderAt into a sequential io.Reader. send()
+// only ever reads forward (retransmission replays cached blocks rather than
+// re-reading the file), so this is safe to use for the netascii encoder.
+type sequentialReaderAt struct {
+	r   io.ReaderAt
+	off int64
+}
+
+func (s *sequentialReaderAt) Read(p []byte) (int, error) {
+	n, err := s.r.ReadAt(p, s.off)
+	s.off += int64(n)
+	return n, err
+}
+
+// netasciiEncoder wraps the file being sent and rewrites it to netascii on
+// the fly, buffering any translated bytes that didn't fit in the caller's
+// slice.
+type netasciiEncoder struct {
+	r       io.Reader
+	pending []byte
+}
+
+func newNetasciiEncoder(r io.Reader) *netasciiEncoder {
+	return &netasciiEncoder{r: r}
+}
+
+func (e *netasciiEncoder) Read(p []byte) (int, error) {
+	if len(e.pending) == 0 {
+		buf := make([]byte, len(p))
+		n, err := e.r.Read(buf)
+		if n > 0 {
+			e.pending = encodeNetascii(buf[:n])
+		}
+		if len(e.pending) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+func encodeNetascii(buf []byte) []byte {
+	out := make([]byte, 0, len(buf))
+	for _, b := range buf {
+		switch b {
+		case '\n':
+			out = append(out, '\r', '\n')
+		case '\r':
+			out = append(out, '\r', 0)
+		default:
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// netasciiDecoder wraps the backend writer on a WRQ and undoes the wire
+// translation before the bytes hit disk: CR LF -> LF, CR NUL -> CR. pendCR
+// carries an unresolved trailing CR across Write calls, i.e. across a DATA
+// block boundary.
+type netasciiDecoder struct {
+	w      io.Writer
+	pendCR bool
+}
+
+func newNetasciiDecoder(w io.Writer) *netasciiDecoder {
+	return &netasciiDecoder{w: w}
+}
+
+func (d *netasciiDecoder) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		if d.pendCR {
+			d.pendCR = false
+			switch b {
+			case '\n':
+				out = append(out, '\n')
+			case 0:
+				out = append(out, '\r')
+			default:
+				// Malformed stream: a bare CR not followed by LF or NUL.
+				// Pass the CR through literally and reprocess b normally.
+				out = append(out, '\r')
+				if b == '\r' {
+					d.pendCR = true
+				} else {
+					out = append(out, b)
+				}
+			}
+			continue
+		}
+		if b == '\r' {
+			d.pendCR = true
+			continue
+		}
+		out = append(out, b)
+	}
+	if _, err := d.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,243 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Packet is a parsed TFTP wire message. Each concrete type below knows how
+// to serialize itself (Pack) and how to populate itself from the bytes of a
+// received datagram (Unpack), so handleClient and the client no longer have
+// to hand-roll binary.BigEndian/bytes.Split parsing themselves.
+type Packet interface {
+	Pack() []byte
+	Unpack(buf []byte) error
+}
+
+// ParsePacket reads the opcode from buf and decodes it into the matching
+// Packet type. It never panics, even on truncated, empty, or otherwise
+// malformed input -- callers (including the fuzz target in packet_test.go)
+// rely on that.
+func ParsePacket(buf []byte) (Packet, error) {
+	if len(buf) < 2 {
+		return nil, fmt.Errorf("packet too short to contain an opcode (%d bytes)", len(buf))
+	}
+
+	var p Packet
+	switch OpCode(binary.BigEndian.Uint16(buf[0:2])) {
+	case OPCODE_RRQ:
+		p = &RRQ{}
+	case OPCODE_WRQ:
+		p = &WRQ{}
+	case OPCODE_DATA:
+		p = &DATA{}
+	case OPCODE_ACK:
+		p = &ACK{}
+	case OPCODE_ERROR:
+		p = &ERROR{}
+	case OPCODE_OACK:
+		p = &OACK{}
+	default:
+		return nil, fmt.Errorf("unknown opcode %d", binary.BigEndian.Uint16(buf[0:2]))
+	}
+
+	if err := p.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// splitFields splits the NUL-delimited fields following an opcode, dropping
+// a trailing empty field left over from the final terminating NUL.
+func splitFields(buf []byte) []string {
+	raw := bytes.Split(buf, []byte{0})
+	if len(raw) > 0 && len(raw[len(raw)-1]) == 0 {
+		raw = raw[:len(raw)-1]
+	}
+	fields := make([]string, len(raw))
+	for i, f := range raw {
+		fields[i] = string(f)
+	}
+	return fields
+}
+
+// RRQ is a read request: the client wants to receive Filename from the
+// server.
+type RRQ struct {
+	Filename string
+	Mode     string
+	Options  map[string]string
+}
+
+func (p *RRQ) Pack() []byte { return packRequest(OPCODE_RRQ, p.Filename, p.Mode, p.Options) }
+func (p *RRQ) Unpack(buf []byte) error {
+	return unpackRequest(buf, OPCODE_RRQ, &p.Filename, &p.Mode, &p.Options)
+}
+
+// WRQ is a write request: the client wants to send Filename to the server.
+type WRQ struct {
+	Filename string
+	Mode     string
+	Options  map[string]string
+}
+
+func (p *WRQ) Pack() []byte { return packRequest(OPCODE_WRQ, p.Filename, p.Mode, p.Options) }
+func (p *WRQ) Unpack(buf []byte) error {
+	return unpackRequest(buf, OPCODE_WRQ, &p.Filename, &p.Mode, &p.Options)
+}
+
+func packRequest(opcode OpCode, filename, mode string, options map[string]string) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, byte(opcode)})
+	buf.WriteString(filename)
+	buf.WriteByte(0)
+	buf.WriteString(mode)
+	buf.WriteByte(0)
+	for key, value := range options {
+		buf.WriteString(key)
+		buf.WriteByte(0)
+		buf.WriteString(value)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func unpackRequest(buf []byte, want OpCode, filename, mode *string, options *map[string]string) error {
+	if len(buf) < 2 {
+		return fmt.Errorf("packet too short to contain an opcode (%d bytes)", len(buf))
+	}
+	opcode := OpCode(binary.BigEndian.Uint16(buf[0:2]))
+	if opcode != want {
+		return fmt.Errorf("opcode %d does not match expected %d", opcode, want)
+	}
+
+	fields := splitFields(buf[2:])
+	if len(fields) < 2 {
+		return fmt.Errorf("request missing filename or mode")
+	}
+	*filename = fields[0]
+	*mode = fields[1]
+
+	opts := make(map[string]string)
+	for i := 2; i+1 < len(fields); i += 2 {
+		opts[fields[i]] = fields[i+1]
+	}
+	*options = opts
+	return nil
+}
+
+// DATA carries one block of file contents.
+type DATA struct {
+	Block uint16
+	Data  []byte
+}
+
+func (p *DATA) Pack() []byte {
+	buf := make([]byte, 4+len(p.Data))
+	binary.BigEndian.PutUint16(buf[0:2], uint16(OPCODE_DATA))
+	binary.BigEndian.PutUint16(buf[2:4], p.Block)
+	copy(buf[4:], p.Data)
+	return buf
+}
+
+func (p *DATA) Unpack(buf []byte) error {
+	if len(buf) < 4 {
+		return fmt.Errorf("DATA packet too short (%d bytes)", len(buf))
+	}
+	if opcode := OpCode(binary.BigEndian.Uint16(buf[0:2])); opcode != OPCODE_DATA {
+		return fmt.Errorf("opcode %d is not DATA", opcode)
+	}
+	p.Block = binary.BigEndian.Uint16(buf[2:4])
+	p.Data = buf[4:]
+	return nil
+}
+
+// ACK acknowledges receipt of Block.
+type ACK struct {
+	Block uint16
+}
+
+func (p *ACK) Pack() []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint16(buf[0:2], uint16(OPCODE_ACK))
+	binary.BigEndian.PutUint16(buf[2:4], p.Block)
+	return buf
+}
+
+func (p *ACK) Unpack(buf []byte) error {
+	if len(buf) < 4 {
+		return fmt.Errorf("ACK packet too short (%d bytes)", len(buf))
+	}
+	if opcode := OpCode(binary.BigEndian.Uint16(buf[0:2])); opcode != OPCODE_ACK {
+		return fmt.Errorf("opcode %d is not ACK", opcode)
+	}
+	p.Block = binary.BigEndian.Uint16(buf[2:4])
+	return nil
+}
+
+// ERROR reports a failure and, except for a handful of cases, ends the
+// transfer.
+type ERROR struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (p *ERROR) Pack() []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, byte(OPCODE_ERROR), byte(p.Code >> 8), byte(p.Code & 0xff)})
+	buf.WriteString(p.Message)
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+func (p *ERROR) Unpack(buf []byte) error {
+	if len(buf) < 4 {
+		return fmt.Errorf("ERROR packet too short (%d bytes)", len(buf))
+	}
+	if opcode := OpCode(binary.BigEndian.Uint16(buf[0:2])); opcode != OPCODE_ERROR {
+		return fmt.Errorf("opcode %d is not ERROR", opcode)
+	}
+	p.Code = ErrorCode(binary.BigEndian.Uint16(buf[2:4]))
+	msg := buf[4:]
+	if i := bytes.IndexByte(msg, 0); i >= 0 {
+		msg = msg[:i]
+	}
+	p.Message = string(msg)
+	return nil
+}
+
+// OACK acknowledges the subset of requested options the server is willing
+// to honor (RFC 2347).
+type OACK struct {
+	Options map[string]string
+}
+
+func (p *OACK) Pack() []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, byte(OPCODE_OACK)})
+	for key, value := range p.Options {
+		buf.WriteString(key)
+		buf.WriteByte(0)
+		buf.WriteString(value)
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func (p *OACK) Unpack(buf []byte) error {
+	if len(buf) < 2 {
+		return fmt.Errorf("packet too short to contain an opcode (%d bytes)", len(buf))
+	}
+	if opcode := OpCode(binary.BigEndian.Uint16(buf[0:2])); opcode != OPCODE_OACK {
+		return fmt.Errorf("opcode %d is not OACK", opcode)
+	}
+
+	fields := splitFields(buf[2:])
+	opts := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		opts[fields[i]] = fields[i+1]
+	}
+	p.Options = opts
+	return nil
+}
@@ -0,0 +1,28 @@
+package tftp
+
+import "testing"
+
+// FuzzParsePacket makes sure malformed datagrams (runt packets, missing
+// NULs, non-UTF8 option keys, opcode 0, ...) never make ParsePacket panic:
+// each either returns an error or a Packet that can be re-encoded.
+func FuzzParsePacket(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 0})
+	f.Add([]byte{0, 1})
+	f.Add([]byte{0, 1, 'a', 0, 'o', 'c', 't', 'e', 't', 0})
+	f.Add([]byte{0, 2, 'a', 0, 'o', 'c', 't', 'e', 't', 0, 't', 's', 'i', 'z', 'e', 0, '0', 0})
+	f.Add([]byte{0, 3, 0, 1, 'h', 'i'})
+	f.Add([]byte{0, 4, 0, 1})
+	f.Add([]byte{0, 5, 0, 2, 'n', 'o', 0})
+	f.Add([]byte{0, 6, 'b', 'l', 'k', 's', 'i', 'z', 'e', 0, '5', '1', '2', 0})
+	f.Add([]byte{0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := ParsePacket(data)
+		if err != nil {
+			return
+		}
+		// A successful parse must also be safe to re-encode.
+		_ = p.Pack()
+	})
+}
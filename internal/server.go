@@ -1,20 +1,43 @@
 package tftp
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// backendErrorCode reports ERR_ACCESS_VIOLATION for the sanitizeFSPath
+// traversal error a Backend returns (see backend.go), or deflt for anything
+// else.
+func backendErrorCode(err error, deflt ErrorCode) ErrorCode {
+	if strings.Contains(err.Error(), "access violation") {
+		return ERR_ACCESS_VIOLATION
+	}
+	return deflt
+}
+
 type TftpServer struct {
 	TftpNode
 	Port int
+
+	// MaxConcurrentTransfers bounds how many RRQ/WRQ sessions may run at
+	// once; 0 means unlimited. Without this, a flood of requests can spawn
+	// enough goroutines (and, for writes, open files) to exhaust FDs.
+	MaxConcurrentTransfers int
+
+	mu     sync.Mutex
+	conn   *net.UDPConn
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	sem    chan struct{}
 }
 
 func (s *TftpServer) Listen() {
@@ -25,6 +48,16 @@ func (s *TftpServer) Listen() {
 	}
 	defer conn.Close()
 
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.mu.Lock()
+	s.conn = conn
+	s.cancel = cancel
+	if s.MaxConcurrentTransfers > 0 {
+		s.sem = make(chan struct{}, s.MaxConcurrentTransfers)
+	}
+	s.mu.Unlock()
+
 	fmt.Println("Started TFTP server on", laddr.String())
 
 	for {
@@ -32,19 +65,71 @@ func (s *TftpServer) Listen() {
 		n, addr, err := conn.ReadFromUDP(buf)
 
 		if err != nil {
+			if ctx.Err() != nil {
+				// Shutdown closed the socket on purpose; stop accepting.
+				return
+			}
 			log.Fatal(err)
 		}
 
 		buf = buf[0:n]
-		go s.handleClient(buf, addr)
+
+		if s.sem != nil {
+			select {
+			case s.sem <- struct{}{}:
+			default:
+				fmt.Fprintln(os.Stderr, "dropping request from", addr, "(too many concurrent transfers)")
+				continue
+			}
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if s.sem != nil {
+				defer func() { <-s.sem }()
+			}
+			s.handleClient(ctx, buf, addr)
+		}()
+	}
+}
+
+// Shutdown stops Listen from accepting new requests and cancels every
+// in-flight transfer (each sends its client an ERROR and returns), then waits
+// for their goroutines to return. It returns ctx.Err() if ctx is done before
+// they all have; in-flight transfers are not allowed to run to completion.
+func (s *TftpServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	conn := s.conn
+	s.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (t *TftpNode) handleClient(req []byte, addr *net.UDPAddr) {
+func (t *TftpNode) handleClient(ctx context.Context, req []byte, addr *net.UDPAddr) {
 	start_time := time.Now()
 
 	s := TftpSession{}
 	s.TftpNode = *t
+	s.ctx = ctx
 
 	connection, err := net.DialUDP("udp", nil, addr)
 	if err != nil {
@@ -64,90 +149,150 @@ func (t *TftpNode) handleClient(req []byte, addr *net.UDPAddr) {
 		return
 	}
 
-	opcode := OpCode(binary.BigEndian.Uint16(req[0:2]))
-
-	req_strings := bytes.Split(req[2:], []byte{0})
-	if len(req_strings[len(req_strings)-1]) == 0 {
-		req_strings = req_strings[:len(req_strings)-1]
-	}
-
-	if len(req_strings) < 2 {
-		err = fmt.Errorf("request missing filename or mode")
+	packet, err := s.codecOrDefault().Unmarshal(req)
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		s.tftpSendError(err, ERR_ILLEGAL_OP)
 		return
 	}
 
-	s.Filename = "./" + string(req_strings[0])
-	s.mode = string(req_strings[1])
+	var opcode OpCode
+	var requestOptions map[string]string
+	switch p := packet.(type) {
+	case *RRQ:
+		opcode = OPCODE_RRQ
+		s.Filename = p.Filename
+		s.mode = p.Mode
+		requestOptions = p.Options
+	case *WRQ:
+		opcode = OPCODE_WRQ
+		s.Filename = p.Filename
+		s.mode = p.Mode
+		requestOptions = p.Options
+	case *DATA, *ACK:
+		// We've received a data or acknowledgement that isn't consistent
+		// with the server's state.
+		s.tftpSendError(fmt.Errorf("who are you?"), ERR_UNKNOWN_TID)
+		return
+	default:
+		s.tftpSendError(fmt.Errorf("unexpected packet %T", packet), ERR_ILLEGAL_OP)
+		return
+	}
+
 	s.blocksize = 512
 	s.timeout = 1 * time.Second
 	s.tsize = 0
 
-	if s.mode != "octet" && s.mode != "binary" {
-		err = fmt.Errorf("server only supports octet mode") // but we will also accept "binary"
+	if s.mode != "octet" && s.mode != "binary" && s.mode != "netascii" {
+		err = fmt.Errorf("server only supports octet and netascii modes") // but we will also accept "binary"
 		fmt.Fprintln(os.Stderr, err)
 		s.tftpSendError(err, ERR_ILLEGAL_OP)
 		return
 	}
 
 	options := make(map[string]string)
-	if len(req_strings) > 2 {
-		//fmt.Printf("TFTP request from %s includes options:\n", connection.RemoteAddr().String())
-		for i := 2; i < len(req_strings); i += 2 {
-			if len(req_strings) < i+2 {
-				break
+	//fmt.Printf("TFTP request from %s includes options:\n", connection.RemoteAddr().String())
+	for key, value := range requestOptions {
+		//fmt.Printf(" - %s = %s", key, value)
+
+		switch key {
+		case "blksize":
+			s.blocksize, err = strconv.Atoi(value)
+		case "timeout":
+			var t int
+			t, err = strconv.Atoi(value)
+			if err == nil && (t <= 0 || 255 < t) {
+				err = fmt.Errorf("timeout %d out of rage [1,255]", t)
+			} else {
+				s.timeout = time.Duration(t) * time.Second
 			}
-			key := string(req_strings[i])
-			value := string(req_strings[i+1])
-			//fmt.Printf(" - %s = %s", key, value)
-
-			switch key {
-			case "blksize":
-				s.blocksize, err = strconv.Atoi(value)
-			case "timeout":
-				var t int
-				t, err = strconv.Atoi(value)
-				if err == nil && (t <= 0 || 255 < t) {
-					err = fmt.Errorf("timeout %d out of rage [1,255]", t)
-				} else {
-					s.timeout = time.Duration(t) * time.Second
+		case "tsize":
+			s.tsize, err = strconv.Atoi(value)
+		case "windowsize":
+			s.window, err = strconv.Atoi(value)
+			if err == nil && (s.window < 1 || 65535 < s.window) {
+				err = fmt.Errorf("windowsize %d out of range [1,65535]", s.window)
+			} else if err == nil {
+				max := t.WindowSize
+				if max < 1 {
+					max = defaultMaxWindowSize
 				}
-			case "tsize":
-				s.tsize, err = strconv.Atoi(value)
-			default:
-				//fmt.Println(" (ignored)")
-				continue
+				if s.window > max {
+					s.window = max
+				}
+				value = strconv.Itoa(s.window)
 			}
+		default:
+			//fmt.Println(" (ignored)")
+			continue
+		}
 
-			if err != nil {
-				s.tftpSendError(err, ERR_UNDEFINED)
-				//fmt.Println(" (error)")
-			} else {
-				options[key] = value
-				//fmt.Println(" (accepted)")
-			}
+		if err != nil {
+			s.tftpSendError(err, ERR_UNDEFINED)
+			//fmt.Println(" (error)")
+		} else {
+			options[key] = value
+			//fmt.Println(" (accepted)")
 		}
 	}
 
+	t.events().OnRequest(addr, s.Filename, opcode)
+
 	switch opcode {
 	case OPCODE_RRQ:
 		fmt.Printf("RRQ from %s for %s\n", addr.String(), s.Filename)
 
-		if _, ok := options["tsize"]; ok {
-			info, err := os.Stat(s.Filename)
-			if err != nil {
-				delete(options, "tsize")
+		if t.Authorizer != nil {
+			if err := t.Authorizer.AllowRead(addr, s.Filename); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				s.tftpSendError(err, ERR_ACCESS_VIOLATION)
+				t.events().OnError(addr, s.Filename, err)
+				return
 			}
-			options["tsize"] = strconv.FormatInt(info.Size(), 10)
+		}
+
+		if t.readHandler == nil && s.mode != "netascii" {
+			if _, ok := options["tsize"]; ok {
+				if size, err := t.backend().Stat(s.Filename, addr); err != nil {
+					delete(options, "tsize")
+				} else {
+					options["tsize"] = strconv.FormatInt(size, 10)
+				}
+			}
+		} else {
+			// Under netascii the on-disk size doesn't match the translated
+			// wire size, and a handler's source has no size up front either.
+			// RFC 2349 allows omitting tsize when it isn't known.
+			delete(options, "tsize")
 		}
 
 		s.tftpSendOptionsAck(&options, opcode)
 
-		err = s.send()
-		if err != nil {
-			fmt.Println("Error sending:", err)
-			return
+		if t.readHandler != nil {
+			if err := t.readHandler(s.Filename, addr, &s); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				s.tftpSendError(err, ERR_NOT_FOUND)
+				t.events().OnError(addr, s.Filename, err)
+				return
+			}
+		} else {
+			reader, _, err := t.backend().OpenRead(s.Filename, addr)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				s.tftpSendError(err, backendErrorCode(err, ERR_NOT_FOUND))
+				t.events().OnError(addr, s.Filename, err)
+				return
+			}
+			if closer, ok := reader.(io.Closer); ok {
+				defer closer.Close()
+			}
+			s.input = reader
+
+			if err := s.send(); err != nil {
+				fmt.Println("Error sending:", err)
+				t.events().OnError(addr, s.Filename, err)
+				return
+			}
 		}
 
 		fmt.Println("\033[33m") // yellow
@@ -158,6 +303,7 @@ func (t *TftpNode) handleClient(req []byte, addr *net.UDPAddr) {
 		fmt.Println(s.Filename,
 			hex.EncodeToString(s.hash.Sum(nil)))
 		fmt.Println("\033[0m") // reset color
+		t.events().OnComplete(addr, s.Filename, s.bytes, hex.EncodeToString(s.hash.Sum(nil)), time.Since(start_time))
 	case OPCODE_WRQ:
 		fmt.Printf("WRQ from %s for %s\n", addr.String(), s.Filename)
 
@@ -165,23 +311,50 @@ func (t *TftpNode) handleClient(req []byte, addr *net.UDPAddr) {
 			err = fmt.Errorf("this server is read-only")
 			s.tftpSendError(err, ERR_ACCESS_VIOLATION)
 			fmt.Println("Rejected WRQ from", addr.String(), "(server is in read-only mode).")
+			t.events().OnError(addr, s.Filename, err)
 			return
 		}
 
-		if _, err := os.Stat(s.Filename); err == nil {
-			// file already exists
-			err = fmt.Errorf("%s already exists", s.Filename)
-			fmt.Fprintln(os.Stderr, err)
-			s.tftpSendError(err, ERR_ALREADY_EXISTS)
+		if t.Authorizer != nil {
+			if err := t.Authorizer.AllowWrite(addr, s.Filename); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				s.tftpSendError(err, ERR_ACCESS_VIOLATION)
+				t.events().OnError(addr, s.Filename, err)
+				return
+			}
+		}
+
+		var writer io.WriteCloser
+		if !t.DiscardData && t.writeHandler == nil {
+			var err error
+			writer, err = t.backend().OpenWrite(s.Filename, addr, s.tsize)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				errcode := ERR_UNDEFINED
+				if strings.Contains(err.Error(), "already exists") {
+					errcode = ERR_ALREADY_EXISTS
+				}
+				s.tftpSendError(err, backendErrorCode(err, errcode))
+				t.events().OnError(addr, s.Filename, err)
+				return
+			}
+			defer writer.Close()
+			s.output = writer
 		}
 
 		s.tftpSendOptionsAck(&options, opcode)
 
 		s.tftpSendAck(0)
 
-		err := s.receive()
+		var err error
+		if t.writeHandler != nil {
+			err = t.writeHandler(s.Filename, addr, &s)
+		} else {
+			err = s.receive()
+		}
 		if err != nil {
 			fmt.Println("Error receiving:", err)
+			t.events().OnError(addr, s.Filename, err)
 			return
 		}
 
@@ -202,13 +375,6 @@ func (t *TftpNode) handleClient(req []byte, addr *net.UDPAddr) {
 			speed_unit)
 		fmt.Println(s.Filename, hex.EncodeToString(s.hash.Sum(nil)))
 		fmt.Println("\033[0m") // reset
-	case OPCODE_DATA, OPCODE_ACK:
-		// We've received a data or acknowledgement that isn't consistent
-		// with the server's state.
-		s.tftpSendError(fmt.Errorf("who are you?"), ERR_UNKNOWN_TID)
-		return
-	default:
-		s.tftpSendError(fmt.Errorf("unexpected opcode (%d)", opcode), ERR_ILLEGAL_OP)
-		return
+		t.events().OnComplete(addr, s.Filename, s.bytes, hex.EncodeToString(s.hash.Sum(nil)), time.Since(start_time))
 	}
 }
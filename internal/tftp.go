@@ -8,11 +8,12 @@ package tftp
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
-	"encoding/binary"
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
 	"net"
 	"os"
 	"strings"
@@ -40,13 +41,75 @@ const (
 	OPCODE_DATA  OpCode = 3
 	OPCODE_ACK   OpCode = 4
 	OPCODE_ERROR OpCode = 5
+	OPCODE_OACK  OpCode = 6
 )
 
+// defaultMaxWindowSize bounds the windowsize a client may negotiate (RFC 7440)
+// when TftpNode.WindowSize is left at its zero value. Fuchsia's tftp defaults
+// to 256; we pick a smaller ceiling since nothing here has been tuned for
+// very fat pipes yet.
+const defaultMaxWindowSize = 64
+
 type TftpNode struct {
 	DiscardData bool
 	ReadOnly    bool
+
+	// WindowSize caps the RFC 7440 windowsize a client may negotiate. Zero
+	// means "use defaultMaxWindowSize".
+	WindowSize int
+
+	// Backend serves RRQ/WRQ data. A nil Backend defaults to an FSBackend
+	// built from FS/WriteFS below, matching GoTFTPd's historical behavior
+	// of serving "./" + filename. Set Backend directly to plug in something
+	// that isn't expressible as an fs.FS, e.g. MapBackend or HTTPBackend.
+	Backend Backend
+
+	// FS and WriteFS back the default Backend's RRQ/WRQ handling when
+	// Backend itself is nil. FS nil defaults to os.DirFS("."); WriteFS nil
+	// defaults to a DirFSWriter rooted at ".". Set FS to an embed.FS for
+	// baked-in read-only firmware, or an fstest.MapFS in tests, without
+	// writing a Backend implementation.
+	FS      fs.FS
+	WriteFS FSWriter
+
+	// Authorizer gates RRQ/WRQ by remote address and filename before the
+	// Backend is touched. Nil means "allow everything".
+	Authorizer Authorizer
+
+	// Events, if set, receives OnRequest/OnComplete/OnError notifications
+	// for every transfer.
+	Events EventHandler
+
+	// readHandler and writeHandler, set via TftpServer.SetReadHandler /
+	// SetWriteHandler, replace the Backend entirely for RRQ/WRQ when set.
+	readHandler  ReadHandlerFunc
+	writeHandler WriteHandlerFunc
+}
+
+// backend returns t.Backend, or an FSBackend wrapping FS/WriteFS (which
+// themselves default to os.DirFS(".") and a DirFSWriter rooted at ".") if
+// none was set.
+func (t *TftpNode) backend() Backend {
+	if t.Backend != nil {
+		return t.Backend
+	}
+	return &FSBackend{FS: t.FS, WriteFS: t.WriteFS}
 }
 
+// events returns t.Events, or a no-op handler if none was set.
+func (t *TftpNode) events() EventHandler {
+	if t.Events != nil {
+		return t.Events
+	}
+	return noopEventHandler{}
+}
+
+type noopEventHandler struct{}
+
+func (noopEventHandler) OnRequest(*net.UDPAddr, string, OpCode)                      {}
+func (noopEventHandler) OnComplete(*net.UDPAddr, string, int, string, time.Duration) {}
+func (noopEventHandler) OnError(*net.UDPAddr, string, error)                         {}
+
 type TftpSession struct {
 	TftpNode
 	Filename    string
@@ -56,9 +119,41 @@ type TftpSession struct {
 	tsize       int
 	mode        string
 	output      io.Writer
+	input       io.ReaderAt // set by the caller (e.g. via a Backend) before send() runs
 	blocks_read uint16
 	bytes       int
 	hash        hash.Hash
+	window      int             // negotiated RFC 7440 windowsize, defaults to 1
+	ctx         context.Context // cancels the transfer; never nil once context() has run
+	codec       Codec           // wire encoding; nil defaults to DefaultCodec
+	seed        Packet          // a reply already read off the wire (e.g. during TftpClient's handshake) to consume before the next conn.Read
+}
+
+// codecOrDefault returns s.codec, or DefaultCodec if none was set.
+func (s *TftpSession) codecOrDefault() Codec {
+	if s.codec != nil {
+		return s.codec
+	}
+	return DefaultCodec
+}
+
+// windowOrDefault returns the negotiated window size, treating the zero
+// value (no windowsize option negotiated) as a window of 1.
+func (s *TftpSession) windowOrDefault() int {
+	if s.window < 1 {
+		return 1
+	}
+	return s.window
+}
+
+// context returns the session's cancellation context, defaulting to
+// context.Background() for sessions that never had one set (e.g. a
+// TftpClient used directly without going through TftpNode.handleClient).
+func (s *TftpSession) context() context.Context {
+	if s.ctx == nil {
+		s.ctx = context.Background()
+	}
+	return s.ctx
 }
 
 func (s *TftpSession) receive() error {
@@ -84,28 +179,74 @@ func (s *TftpSession) receive() error {
 	}
 
 	s.hash = md5.New()
-	writer := io.MultiWriter(s.output, s.hash)
+	out := s.output
+	if s.mode == "netascii" {
+		out = newNetasciiDecoder(s.output)
+	}
+	writer := io.MultiWriter(out, s.hash)
+	window := s.windowOrDefault()
+	received_in_window := 0
+	ctx := s.context()
+	retries := 0
 
 	for {
-		// we've acknowledged that we will accept the file, so now receive it.
-		read_buffer := make([]byte, s.blocksize+4)
+		select {
+		case <-ctx.Done():
+			err := ctx.Err()
+			s.tftpSendError(err, ERR_UNDEFINED)
+			return err
+		default:
+		}
 
-		s.conn.SetReadDeadline(time.Now().Add(s.timeout))
-		n, err := s.conn.Read(read_buffer)
+		var packet Packet
+		var err error
+		if s.seed != nil {
+			// Consume the reply TftpClient.Transfer already read off the
+			// wire during the handshake, instead of waiting out a full
+			// timeout for the sender to retransmit it.
+			packet, s.seed = s.seed, nil
+		} else {
+			// we've acknowledged that we will accept the file, so now receive it.
+			read_buffer := make([]byte, s.blocksize+4)
+
+			s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+			var n int
+			n, err = s.conn.Read(read_buffer)
+
+			if n < 0 || err != nil { // timeout
+				fmt.Fprint(os.Stderr, "\033[31m") // red
+				fmt.Fprint(os.Stderr, err)
+				fmt.Fprintln(os.Stderr, "\033[0m") // reset
+				if retries >= 6 {
+					s.tftpSendError(err, ERR_UNDEFINED)
+					return err
+				}
+				retries++
+				// Re-ack the last block we have so a sender waiting on it
+				// (or whose DATA we missed) retransmits right away, mirroring
+				// the 6-retry retransmission send() already does.
+				s.tftpSendAck(s.blocks_read)
+				continue
+			}
 
-		if n < 0 || err != nil { // timeout
-			fmt.Fprint(os.Stderr, "\033[31m") // red
-			fmt.Fprint(os.Stderr, err)
-			fmt.Fprintln(os.Stderr, "\033[0m") // reset
-			// DON'T send an error.
-			continue
+			packet, err = s.codecOrDefault().Unmarshal(read_buffer[:n])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
 		}
+		retries = 0
 
-		block := binary.BigEndian.Uint16(read_buffer[2:4])
+		data, ok := packet.(*DATA)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "expected DATA, got %T\n", packet)
+			continue
+		}
+		block := data.Block
 
 		if block == s.blocks_read+1 {
 			// we read the expected block
-			_, err = io.Copy(writer, bytes.NewReader(read_buffer[4:n]))
+			_, err = io.Copy(writer, bytes.NewReader(data.Data))
 
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
@@ -113,62 +254,116 @@ func (s *TftpSession) receive() error {
 				continue
 			}
 
-			// we've received, now acknowledge receipt.
-			s.tftpSendAck(block)
 			s.blocks_read++
-			s.bytes += n
+			s.bytes += len(data.Data)
+			received_in_window++
 
-			if n < s.blocksize {
+			if len(data.Data) < s.blocksize {
+				// final, possibly short, block: always ack right away.
+				s.tftpSendAck(block)
 				break
 			}
+
+			if received_in_window >= window {
+				// only ack the last contiguous block of the window, per RFC 7440
+				s.tftpSendAck(block)
+				received_in_window = 0
+			}
 		} else if block <= s.blocks_read {
-			// duplicate packet?
+			// duplicate packet, possibly from a rewound window: re-ack so the
+			// sender can catch up without waiting for its timeout.
 			s.tftpSendAck(block)
-			s.bytes += n
-			continue
+			received_in_window = 0
 		} else {
+			// out-of-order block: a gap in the window. Drop it and ack the
+			// last contiguous block so the sender rewinds and retransmits.
 			err = fmt.Errorf("received %s block %d, expected %d",
 				s.Filename, block, s.blocks_read+1)
 			fmt.Fprintln(os.Stderr, err)
-			//s.tftpSendError(err, ERR_UNDEFINED)
-			// Don't send an error here. Instead, send an ack of the last valid block.
 			s.tftpSendAck(s.blocks_read)
-			continue
+			received_in_window = 0
 		}
 	}
 
 	return nil
 }
 
-func (s *TftpSession) send() error {
-	var buf bytes.Buffer
+// windowBlock is one outstanding (sent but not yet acknowledged) DATA block,
+// kept around so a rewind can retransmit it without re-reading the file.
+type windowBlock struct {
+	seq  uint16
+	data []byte
+	last bool
+}
 
-	file, err := os.Open(s.Filename)
-	if err != nil {
-		s.tftpSendError(err, ERR_NOT_FOUND)
-		return err
+func (s *TftpSession) send() error {
+	file := s.input
+	if file == nil {
+		f, err := os.Open(s.Filename)
+		if err != nil {
+			s.tftpSendError(err, ERR_NOT_FOUND)
+			return err
+		}
+		defer f.Close()
+		file = f
 	}
-	defer file.Close()
 
-	write_buffer := make([]byte, s.blocksize)
 	s.hash = md5.New()
-	writer := io.MultiWriter(&buf, s.hash)
+	window := s.windowOrDefault()
 	retries := 0
-	i := uint16(1)
+	next := uint16(1) // next block to read from the file
+	eof := false      // true once the final (possibly short) block has been read
+	var pending []windowBlock
+
+	var netReader io.Reader
+	if s.mode == "netascii" {
+		netReader = newNetasciiEncoder(&sequentialReaderAt{r: file})
+	}
+
+	transmit := func(b windowBlock) {
+		wire, _ := s.codecOrDefault().Marshal(&DATA{Block: b.seq, Data: b.data})
+		s.conn.Write(wire)
+	}
+
+	fill := func() error {
+		for len(pending) < window && !eof {
+			write_buffer := make([]byte, s.blocksize)
+			var n int
+			var err error
+			if netReader != nil {
+				n, err = io.ReadFull(netReader, write_buffer)
+			} else {
+				n, err = file.ReadAt(write_buffer, int64(next-1)*int64(s.blocksize))
+			}
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				fmt.Printf("I/O problem during transfer: %s.", err)
+				s.tftpSendError(err, ERR_UNDEFINED)
+				return err
+			}
+			b := windowBlock{seq: next, data: write_buffer[:n], last: n < s.blocksize}
+			transmit(b)
+			pending = append(pending, b)
+			if b.last {
+				eof = true
+			}
+			next++
+		}
+		return nil
+	}
 
+	if err := fill(); err != nil {
+		return err
+	}
+
+	ctx := s.context()
 	for {
-		n, err := file.ReadAt(write_buffer, int64((i-1))*int64(s.blocksize))
-		if err != nil && err != io.EOF {
-			fmt.Printf("I/O problem during transfer: %s.", err)
+		select {
+		case <-ctx.Done():
+			err := ctx.Err()
 			s.tftpSendError(err, ERR_UNDEFINED)
 			return err
+		default:
 		}
-		buf.Write([]byte{0, byte(OPCODE_DATA)})         // TFTP data packet
-		buf.Write([]byte{byte(i >> 8), byte(0xff & i)}) // block #
-		writer.Write(write_buffer[:n])
-		s.conn.Write(buf.Bytes())
-		buf.Reset()
-		s.bytes += n
 
 		s.conn.SetReadDeadline(time.Now().Add(s.timeout))
 		block, err2 := s.tftpReceiveAck()
@@ -177,6 +372,9 @@ func (s *TftpSession) send() error {
 				// Retry the transmission 6 times before giving up.
 				if retries < 6 {
 					retries++
+					for _, b := range pending {
+						transmit(b)
+					}
 				} else {
 					s.tftpSendError(err2, ERR_UNDEFINED)
 					return err2
@@ -187,18 +385,48 @@ func (s *TftpSession) send() error {
 			} else {
 				// We got some other error that we can try to recover from.
 				fmt.Println(err2)
-				continue
 			}
+			continue
 		}
+		retries = 0
 
-		if block == i {
-			i++
+		idx := -1
+		for i, b := range pending {
+			if b.seq == block {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			if len(pending) > 0 && block == s.blocks_read {
+				// The receiver re-acked the last block it already has in
+				// order, meaning it saw a gap in our window. Retransmit the
+				// whole window immediately instead of waiting for a timeout.
+				for _, b := range pending {
+					transmit(b)
+				}
+			}
+			// Otherwise: a stale duplicate from before the window (block <
+			// base-1) or nonsense (block > base+window). Either way there's
+			// nothing to advance.
+			continue
 		}
 
-		if n == 0 || err == io.EOF {
-			s.blocks_read = block
+		last := pending[idx].last
+		for i := 0; i <= idx; i++ {
+			s.hash.Write(pending[i].data)
+			s.bytes += len(pending[i].data)
+		}
+		pending = pending[idx+1:]
+		s.blocks_read = block
+
+		if last && len(pending) == 0 {
 			break
 		}
+
+		if err := fill(); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -220,42 +448,46 @@ func speed(bytes int, start time.Time) (rate float64, unit string) {
 }
 
 func (s *TftpSession) tftpSendError(err error, errcode ErrorCode) {
-	var buf bytes.Buffer
-	buf.Write([]byte{0, 5, byte(errcode >> 8), byte(errcode & 0xff)}) // TFTP error packet with no defined error code
-	buf.Write([]byte(fmt.Sprint(err)))
-	s.conn.Write(buf.Bytes())
+	wire, _ := s.codecOrDefault().Marshal(&ERROR{Code: errcode, Message: fmt.Sprint(err)})
+	s.conn.Write(wire)
 }
 
 func (s *TftpSession) tftpReceiveAck() (block uint16, err error) {
-	read_buffer := make([]byte, 1500)
-	n, _, err := s.conn.ReadFrom(read_buffer)
-	if err != nil {
-		return
-	}
+	var packet Packet
+	if s.seed != nil {
+		// Consume the reply TftpClient.Transfer already read off the wire
+		// during the handshake, instead of waiting out a full timeout for
+		// the receiver to retransmit it.
+		packet, s.seed = s.seed, nil
+	} else {
+		read_buffer := make([]byte, 1500)
+		n, _, rerr := s.conn.ReadFrom(read_buffer)
+		if rerr != nil {
+			err = rerr
+			return
+		}
 
-	if n < 4 {
-		err = fmt.Errorf("ack length is not 4 bytes (actual: %d)", n)
-		return
+		packet, err = s.codecOrDefault().Unmarshal(read_buffer[:n])
+		if err != nil {
+			return
+		}
 	}
 
-	opcode := OpCode(binary.BigEndian.Uint16(read_buffer[:2]))
-	switch opcode {
-	case OPCODE_ACK:
-		block = binary.BigEndian.Uint16(read_buffer[2:4])
-	case OPCODE_ERROR:
-		err = fmt.Errorf("received TFTP error from %s: %s", s.conn.RemoteAddr().String(), string(read_buffer[4:]))
+	switch p := packet.(type) {
+	case *ACK:
+		block = p.Block
+	case *ERROR:
+		err = fmt.Errorf("received TFTP error from %s: %s", s.conn.RemoteAddr().String(), p.Message)
 	default:
-		err = fmt.Errorf("unexpected opcode=%d", opcode)
+		err = fmt.Errorf("unexpected packet %T", packet)
 	}
 
 	return
 }
 
 func (s *TftpSession) tftpSendAck(block uint16) {
-	var buf bytes.Buffer
-	buf.Write([]byte{0, 4})
-	buf.Write([]byte{byte(block >> 8), byte(0xff & block)})
-	s.conn.Write(buf.Bytes())
+	wire, _ := s.codecOrDefault().Marshal(&ACK{Block: block})
+	s.conn.Write(wire)
 }
 
 func (s *TftpSession) tftpSendOptionsAck(options *map[string]string, opcode OpCode) {
@@ -264,15 +496,8 @@ func (s *TftpSession) tftpSendOptionsAck(options *map[string]string, opcode OpCo
 	}
 
 	// https://datatracker.ietf.org/doc/html/rfc2347
-	var buf bytes.Buffer
-	buf.Write([]byte{0, 6})
-	for key, value := range *options {
-		buf.WriteString(key)
-		buf.WriteByte(0)
-		buf.WriteString(value)
-		buf.WriteByte(0)
-	}
-	s.conn.Write(buf.Bytes())
+	wire, _ := s.codecOrDefault().Marshal(&OACK{Options: *options})
+	s.conn.Write(wire)
 
 	if opcode == OPCODE_RRQ {
 		zero, err := s.tftpReceiveAck()